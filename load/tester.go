@@ -2,16 +2,22 @@ package load
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
@@ -21,16 +27,268 @@ const bodyLengthAllowedChange = 10
 const bufferSize = 16 << 10
 const clientName = "http-load-tester"
 
+// latencyHistMinMicros is the lower bound of the histogram's smallest bucket range, in
+// microseconds.
+const latencyHistMinMicros = 100
+
+// latencyHistNumPowers is the number of power-of-two bucket ranges tracked by the histogram,
+// covering [100µs, 100µs*2^20) ~= [100µs, 105s).
+const latencyHistNumPowers = 20
+
+// latencyHistSubBuckets is the number of linear sub-buckets within each power-of-two range.
+const latencyHistSubBuckets = 16
+
+// latencyHistNumBuckets is the total number of counters in the histogram.
+const latencyHistNumBuckets = latencyHistNumPowers * latencyHistSubBuckets
+
 // Tester tests some URLs, performing basic validation as it goes.
 type Tester struct {
-	urls          []string
-	responseByUrl map[string]expectedResponseData
+	specs         []RequestSpec
+	cumWeights    []float64
+	totalWeight   float64
+	responseByKey map[string]expectedResponseData
 	client        *fasthttp.Client
+	retryPolicy   *RetryPolicy
+	faultInjector *FaultInjector
+	metrics       *testerMetrics
+}
+
+// RequestSpec describes one kind of request a Tester can issue, so that a single Tester can
+// model a realistic mixed workload (e.g. 90% GET /feed, 9% POST /like, 1% POST /upload).
+type RequestSpec struct {
+	// URL is the full URL to request.
+	URL string
+	// Method is the HTTP method to use. Defaults to GET if empty.
+	Method string
+	// Headers are added to every request for this spec.
+	Headers map[string]string
+	// Body is sent as the request body, if non-empty. Callers should share a single []byte
+	// across specs that use the same body, rather than re-allocating it per spec, to keep the
+	// hot path allocation-free.
+	Body []byte
+	// Weight controls how often this spec is chosen relative to the Tester's other specs.
+	// Values <= 0 behave as 1.
+	Weight float64
+}
+
+// key identifies the spec for result reporting and for looking up its expected response.
+func (s *RequestSpec) key() string {
+	return s.Method + " " + s.URL
+}
+
+// TesterOption configures optional behavior on a Tester, for use with NewTester.
+type TesterOption func(*Tester)
+
+// WithRetryPolicy configures the Tester to retry failed requests according to policy, rather
+// than counting every transport error or non-2xx status as an immediate failure. Retries are
+// spaced using decorrelated jitter, the backoff schedule recommended by AWS's "Exponential
+// Backoff And Jitter" architecture blog post: sleep = min(MaxDelay, random_between(BaseDelay,
+// prevSleep*3)).
+func WithRetryPolicy(policy RetryPolicy) TesterOption {
+	return func(t *Tester) {
+		t.retryPolicy = &policy
+	}
+}
+
+// WithFaultInjector configures the Tester to probabilistically corrupt its own requests
+// according to injector, so that the tester's own behavior (retry policy, error-threshold
+// abort, percentile math) can be regression-tested without a real flaky server.
+func WithFaultInjector(injector FaultInjector) TesterOption {
+	return func(t *Tester) {
+		t.faultInjector = &injector
+	}
+}
+
+// WithMetrics registers Prometheus collectors on registerer and configures the Tester to keep
+// them updated as it runs, so a running stress test can be observed live rather than only after a
+// stage completes: loadtester_requests_total{url,outcome}, loadtester_bytes_received_total{url},
+// loadtester_request_duration_seconds{url}, loadtester_concurrency, and loadtester_error_rate.
+// One prometheus.Observer per RequestSpec.URL is resolved at Init time, so the hot request path
+// never performs a per-request label lookup.
+func WithMetrics(registerer prometheus.Registerer) TesterOption {
+	return func(t *Tester) {
+		t.metrics = newTesterMetrics(registerer)
+	}
+}
+
+// testerMetrics holds the Prometheus collectors updated by a Tester configured with WithMetrics.
+type testerMetrics struct {
+	requestsTotal      *prometheus.CounterVec
+	bytesReceivedTotal *prometheus.CounterVec
+	requestDuration    *prometheus.HistogramVec
+	concurrency        prometheus.Gauge
+	errorRate          prometheus.Gauge
+}
+
+func newTesterMetrics(registerer prometheus.Registerer) *testerMetrics {
+	m := &testerMetrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadtester_requests_total",
+			Help: "Total number of requests issued, by url and outcome (success or failure).",
+		}, []string{"url", "outcome"}),
+		bytesReceivedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadtester_bytes_received_total",
+			Help: "Total number of response bytes received, by url.",
+		}, []string{"url"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "loadtester_request_duration_seconds",
+			Help:    "Request latency in seconds, by url.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"url"}),
+		concurrency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "loadtester_concurrency",
+			Help: "Concurrency (or, in rate mode, max in-flight requests) used by the current stage.",
+		}),
+		errorRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "loadtester_error_rate",
+			Help: "Ratio of failed to successful requests in the current stage.",
+		}),
+	}
+	registerer.MustRegister(m.requestsTotal, m.bytesReceivedTotal, m.requestDuration, m.concurrency, m.errorRate)
+	return m
+}
+
+// requestMetricHandles holds the Prometheus collectors pre-resolved for one RequestSpec's URL, so
+// that recording a request's outcome never performs a per-request label lookup.
+type requestMetricHandles struct {
+	successes prometheus.Counter
+	failures  prometheus.Counter
+	bytes     prometheus.Counter
+	duration  prometheus.Observer
+}
+
+func (t *Tester) handlesFor(spec *RequestSpec) requestMetricHandles {
+	return requestMetricHandles{
+		successes: t.metrics.requestsTotal.WithLabelValues(spec.URL, "success"),
+		failures:  t.metrics.requestsTotal.WithLabelValues(spec.URL, "failure"),
+		bytes:     t.metrics.bytesReceivedTotal.WithLabelValues(spec.URL),
+		duration:  t.metrics.requestDuration.WithLabelValues(spec.URL),
+	}
+}
+
+// recordStageMetrics updates the concurrency and error rate gauges once per stage, if metrics are
+// enabled. Per-request counters and the duration histogram change on every request instead, so
+// they're updated directly by fetchAndVerifyUrl and fetchAndVerifyUrlSince.
+func (t *Tester) recordStageMetrics(concurrency int, results *StressResult) {
+	if t.metrics == nil {
+		return
+	}
+	t.metrics.concurrency.Set(float64(concurrency))
+	var numSuccess, numFailures int64
+	for _, r := range results.ResultsByUrl {
+		numSuccess += r.Successes.NumCalls
+		numFailures += r.Failures.NumCalls
+	}
+	if numSuccess == 0 {
+		return
+	}
+	t.metrics.errorRate.Set(float64(numFailures) / float64(numSuccess))
+}
+
+// FaultInjector configures fault injection applied by a Tester to each individual request
+// attempt, to simulate an unstable network or server.
+type FaultInjector struct {
+	// ErrorRate controls how often an attempt fails, in [0, 1]: an attempt is dropped before it
+	// is sent with probability ErrorRate/2, and an attempt that completes has its response
+	// rewritten so it fails validation with a further, independent probability of ErrorRate/2.
+	// The combined failure probability is therefore ErrorRate - ErrorRate²/4 (0.75 at 1).
+	ErrorRate float64
+	// LatencyP50 and LatencyP99 parameterize an additional, log-normally distributed latency
+	// injected into every attempt that is not dropped before send, letting callers simulate a
+	// realistic tail without every request taking the full p99 delay.
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+}
+
+// faultInjectedCorruptStatusCode is used to mark a response as corrupted by a FaultInjector; 599
+// is not assigned a meaning by the HTTP specification.
+const faultInjectedCorruptStatusCode = 599
+
+var errFaultInjectedDrop = errors.New("fault injector: request dropped before send")
+
+func (f *FaultInjector) shouldDropBeforeSend() bool {
+	return rand.Float64() < f.ErrorRate/2
+}
+
+func (f *FaultInjector) shouldCorruptResponse() bool {
+	return rand.Float64() < f.ErrorRate/2
+}
+
+// sampleLatency draws an extra latency to inject from a log-normal distribution fit to the
+// configured p50 and p99.
+func (f *FaultInjector) sampleLatency() time.Duration {
+	if f.LatencyP50 <= 0 && f.LatencyP99 <= 0 {
+		return 0
+	}
+	p50 := float64(f.LatencyP50)
+	if p50 <= 0 {
+		p50 = 1
+	}
+	mu := math.Log(p50)
+	sigma := 0.0
+	if p99 := float64(f.LatencyP99); p99 > p50 {
+		// z-score of the 99th percentile of a standard normal distribution.
+		const z99 = 2.326
+		sigma = (math.Log(p99) - mu) / z99
+	}
+	return time.Duration(math.Exp(mu + sigma*rand.NormFloat64()))
+}
+
+// RetryPolicy configures how a Tester retries a single request before giving up and recording
+// its outcome in Successes/Failures.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts (including the first) made for a single
+	// request. Values less than 1 behave as 1, i.e. no retries.
+	MaxAttempts int
+	// BaseDelay is the minimum backoff delay before a retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff delay before a retry.
+	MaxDelay time.Duration
+	// RetryableStatusCodes lists response status codes that should be retried rather than
+	// counted as an immediate failure.
+	RetryableStatusCodes map[int]bool
+	// RetryTransportErrors, when true, retries transport-level errors such as connection
+	// refused, EOF, and a deadline exceeded on the request's context. A canceled context is
+	// never retried, since that indicates the caller no longer wants the result.
+	RetryTransportErrors bool
+}
+
+// isRetryable reports whether a request that got statusCode (with err set instead, on a
+// transport error) should be retried under this policy.
+func (p *RetryPolicy) isRetryable(statusCode int, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		return p.RetryTransportErrors
+	}
+	return p.RetryableStatusCodes[statusCode]
+}
+
+// nextBackoff computes the next decorrelated-jitter backoff delay, given the previous delay
+// (or BaseDelay, for the first retry).
+func (p *RetryPolicy) nextBackoff(prev time.Duration) time.Duration {
+	lower := p.BaseDelay
+	upper := prev * 3
+	if upper > p.MaxDelay {
+		upper = p.MaxDelay
+	}
+	if upper <= lower {
+		return lower
+	}
+	return lower + time.Duration(rand.Int63n(int64(upper-lower)))
 }
 
 // StressResult returns the results of a stress test.
 type StressResult struct {
 	ResultsByUrl map[string]*ResultWithValidity
+
+	// Concurrency is the concurrency level (for Stress) or max in-flight requests (for
+	// StressAtRate) that this stage ran at.
+	Concurrency int
+	// StageStart and StageEnd bound the wall-clock time this stage ran for.
+	StageStart time.Time
+	StageEnd   time.Time
 }
 
 // ResultWithValidity provides separate results for sucessful and failed fetches.
@@ -46,54 +304,123 @@ type AggregateResult struct {
 	TotalLatency       time.Duration
 	MaxLatency         time.Duration
 	MinLatency         time.Duration
+
+	// NumDropped counts requests that StressAtRate could not dispatch because maxInFlight
+	// requests were already in flight. It is only ever populated by StressAtRate.
+	NumDropped int64
+
+	// NumRetries counts retry attempts made under a Tester's RetryPolicy. It does not count
+	// the initial attempt.
+	NumRetries int64
+	// TotalRetryBackoff is the total time spent sleeping between retry attempts.
+	TotalRetryBackoff time.Duration
+
+	// latencyHistogram buckets per-request latencies so percentiles can be reported without
+	// keeping every sample around. Buckets are logarithmic (base 2) at the top level and linear
+	// within each power-of-two range, which keeps merges an allocation-free, element-wise sum.
+	latencyHistogram [latencyHistNumBuckets]int64
 }
 
+// RateStyle determines how request issue times are distributed by StressAtRate.
+type RateStyle string
+
+const (
+	// RateStyleFixed issues requests at a fixed interval of 1/requestsPerSecond.
+	RateStyleFixed RateStyle = "fixed"
+	// RateStylePoisson issues requests with inter-arrival times drawn from an exponential
+	// distribution, matching a Poisson arrival process.
+	RateStylePoisson RateStyle = "poisson"
+)
+
 type urlResult struct {
 	isValid       bool
 	bytesReceived int
 	latency       time.Duration
+	numRetries    int64
+	retryBackoff  time.Duration
 }
 
 type expectedResponseData struct {
 	StatusCode int
 	MinLength  int
 	MaxLength  int
+	metrics    requestMetricHandles
+}
+
+// record updates exp's pre-resolved Prometheus collectors with r's outcome, if metrics are
+// enabled.
+func (exp *expectedResponseData) record(metricsEnabled bool, r urlResult) {
+	if !metricsEnabled {
+		return
+	}
+	if r.isValid {
+		exp.metrics.successes.Inc()
+	} else {
+		exp.metrics.failures.Inc()
+	}
+	exp.metrics.bytes.Add(float64(r.bytesReceived))
+	exp.metrics.duration.Observe(r.latency.Seconds())
 }
 
-// NewTester constructs a new tester object.
-func NewTester(maxConcurrency int) *Tester {
-	return &Tester{
+// NewTester constructs a new tester object. By default it does not retry failed requests; pass
+// WithRetryPolicy to change that.
+func NewTester(maxConcurrency int, opts ...TesterOption) *Tester {
+	t := &Tester{
 		client: &fasthttp.Client{
 			Name:            "http-load-tester",
 			MaxConnsPerHost: maxConcurrency,
-			// Don't retry because we want to know if requests are failing.
+			// Don't let fasthttp retry on our behalf; retries are handled by Tester's own
+			// RetryPolicy so that attempts and outcomes are accounted for correctly.
 			RetryIf: func(r *fasthttp.Request) bool { return false },
 		},
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
-// Init prepares this tester to stress test the given URLs.
-func (t *Tester) Init(urls []string) error {
-	t.urls = urls
-	t.responseByUrl = make(map[string]expectedResponseData)
+// Init prepares this tester to stress test the given request specs.
+func (t *Tester) Init(specs []RequestSpec) error {
+	t.specs = make([]RequestSpec, len(specs))
+	copy(t.specs, specs)
+	t.cumWeights = make([]float64, len(t.specs))
+	t.totalWeight = 0
+	for i := range t.specs {
+		if t.specs[i].Method == "" {
+			t.specs[i].Method = http.MethodGet
+		}
+		if t.specs[i].Weight <= 0 {
+			t.specs[i].Weight = 1
+		}
+		t.totalWeight += t.specs[i].Weight
+		t.cumWeights[i] = t.totalWeight
+	}
+
+	t.responseByKey = make(map[string]expectedResponseData)
 	req := fasthttp.AcquireRequest()
-	log.Println("Expected response for URLs:")
+	log.Println("Expected response for requests:")
 	atLeastOneSucceeded := false
-	for _, u := range urls {
+	for i := range t.specs {
+		spec := &t.specs[i]
 		req.Reset()
-		prepRequest(req, u, 1)
+		prepRequest(req, spec, 1)
 		resp := fasthttp.AcquireResponse()
 		err := t.client.Do(req, resp)
 		if err != nil {
-			return fmt.Errorf("failed to fetch url %v: %v", u, err.Error())
+			return fmt.Errorf("failed to fetch %v: %v", spec.key(), err.Error())
 		}
 		bodyLen := len(resp.Body())
-		t.responseByUrl[u] = expectedResponseData{
+		exp := expectedResponseData{
 			StatusCode: resp.StatusCode(),
 			MinLength:  bodyLen - bodyLengthAllowedChange,
 			MaxLength:  bodyLen + bodyLengthAllowedChange,
 		}
-		log.Printf("%v | %v", resp.StatusCode(), u)
+		if t.metrics != nil {
+			exp.metrics = t.handlesFor(spec)
+		}
+		t.responseByKey[spec.key()] = exp
+		log.Printf("%v | %v", resp.StatusCode(), spec.key())
 		if resp.StatusCode() >= 200 && resp.StatusCode() < 300 {
 			atLeastOneSucceeded = true
 		}
@@ -107,6 +434,7 @@ func (t *Tester) Init(urls []string) error {
 // Stress tests the urls in this tester by sending concurrent requests until the given context is
 // canceled.
 func (t *Tester) Stress(ctx context.Context, concurrency int) (*StressResult, error) {
+	stageStart := time.Now()
 	g, ctx := errgroup.WithContext(ctx)
 
 	resultChan := make(chan StressResult)
@@ -128,9 +456,81 @@ func (t *Tester) Stress(ctx context.Context, concurrency int) (*StressResult, er
 		return nil, err
 	}
 
+	results.Concurrency = concurrency
+	results.StageStart = stageStart
+	results.StageEnd = time.Now()
+	t.recordStageMetrics(concurrency, results)
 	return results, nil
 }
 
+// StressAtRate stress tests the urls in this tester using an open-model load generator: request
+// issue times are scheduled independently of response times at the given requestsPerSecond, and
+// a bounded pool of at most maxInFlight requests is serviced concurrently. Latency is measured
+// from the scheduled issue time, not from when a worker happens to pick the request up, so
+// queueing delay under an overloaded server shows up in the reported histogram. Requests that
+// cannot be dispatched because maxInFlight requests are already in flight are dropped and counted
+// in AggregateResult.NumDropped, rather than blocking the scheduler and further distorting the
+// offered load.
+func (t *Tester) StressAtRate(ctx context.Context, requestsPerSecond float64, maxInFlight int, style RateStyle) (*StressResult, error) {
+	if requestsPerSecond <= 0 {
+		return nil, errors.New("requestsPerSecond must be greater than 0")
+	}
+	if maxInFlight <= 0 {
+		return nil, errors.New("maxInFlight must be greater than 0")
+	}
+	stageStart := time.Now()
+	meanInterval := time.Duration(float64(time.Second) / requestsPerSecond)
+
+	result := newStressResult()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, maxInFlight)
+
+	timer := time.NewTimer(nextArrivalInterval(style, meanInterval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			result.Concurrency = maxInFlight
+			result.StageStart = stageStart
+			result.StageEnd = time.Now()
+			t.recordStageMetrics(maxInFlight, result)
+			return result, nil
+		case scheduledAt := <-timer.C:
+			timer.Reset(nextArrivalInterval(style, meanInterval))
+			spec := t.randomSpec()
+			select {
+			case inFlight <- struct{}{}:
+				wg.Add(1)
+				go func(spec *RequestSpec, scheduledAt time.Time) {
+					defer wg.Done()
+					defer func() { <-inFlight }()
+					r := t.fetchAndVerifyUrlSince(spec, maxInFlight, scheduledAt)
+					mu.Lock()
+					result.add(spec.key(), r)
+					mu.Unlock()
+				}(spec, scheduledAt)
+			default:
+				mu.Lock()
+				result.addDropped(spec.key())
+				mu.Unlock()
+			}
+		}
+	}
+}
+
+// nextArrivalInterval returns the time until the next request should be issued, given the
+// desired arrival style and the mean interval implied by the target request rate.
+func nextArrivalInterval(style RateStyle, meanInterval time.Duration) time.Duration {
+	switch style {
+	case RateStylePoisson:
+		return time.Duration(rand.ExpFloat64() * float64(meanInterval))
+	default:
+		return meanInterval
+	}
+}
+
 // Summary provides the summary results over all URLs.
 func (r *StressResult) Summary() ResultWithValidity {
 	summary := ResultWithValidity{}
@@ -154,12 +554,24 @@ func (r *StressResult) SummaryString() string {
 	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.averageLatencyMillis()))
 	b.WriteString("\nMax success latency (ms): ")
 	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.maxLatencyMillis()))
+	b.WriteString("\nP50 success latency (ms): ")
+	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.p50LatencyMillis()))
+	b.WriteString("\nP90 success latency (ms): ")
+	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.p90LatencyMillis()))
+	b.WriteString("\nP99 success latency (ms): ")
+	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.p99LatencyMillis()))
+	b.WriteString("\nP99.9 success latency (ms): ")
+	b.WriteString(fmt.Sprintf("%.3f", summary.Successes.p999LatencyMillis()))
 	b.WriteString("\nAvg success bytes per response: ")
 	b.WriteString(fmt.Sprintf("%.3f", float64(summary.Successes.TotalBytesReceived)/float64(summary.Successes.NumCalls)))
 	b.WriteString("\nAvg success bytes per second: ")
 	b.WriteString(fmt.Sprintf("%.3f", float64(summary.Successes.TotalBytesReceived)/summary.Successes.averageLatencyMillis()))
 	b.WriteString("\nAvg error latency (ms): ")
 	b.WriteString(fmt.Sprintf("%.3f", summary.Failures.averageLatencyMillis()))
+	b.WriteString("\nCount Retries: ")
+	b.WriteString(strconv.FormatInt(summary.Successes.NumRetries+summary.Failures.NumRetries, 10))
+	b.WriteString("\nTotal Retry Backoff (ms): ")
+	b.WriteString(fmt.Sprintf("%.3f", toMillisAtMicroPrecision(summary.Successes.TotalRetryBackoff+summary.Failures.TotalRetryBackoff)))
 	return b.String()
 }
 
@@ -173,18 +585,22 @@ func (r *StressResult) String() string {
 			lenLongestUrl = uLen
 		}
 	}
-	urlHeading := "URL"
+	urlHeading := "Request"
 	successHeading := "Count Success"
 	failureHeading := "Count Failure"
 	minLatencyHeading := "Min Latency (ms)"
 	latencyHeading := "Avg Latency (ms)"
 	maxLatencyHeading := "Max Latency (ms)"
+	p50Heading := "P50 Latency (ms)"
+	p90Heading := "P90 Latency (ms)"
+	p99Heading := "P99 Latency (ms)"
+	p999Heading := "P99.9 Latency (ms)"
 	bytesHeading := "Bytes Per Resp"
 	bytesPSHeading := "Avg Bytes / s"
-	headerFormatString := fmt.Sprintf("%%-%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds\n", lenLongestUrl, len(successHeading), len(failureHeading), len(minLatencyHeading), len(latencyHeading), len(maxLatencyHeading), len(bytesHeading), len(bytesPSHeading))
-	dataFormatString := fmt.Sprintf("%%-%ds | %%%dd | %%%dd | %%%d.3f | %%%d.3f | %%%d.3f | %%%dd | %%%d.3f\n", lenLongestUrl, len(successHeading), len(failureHeading), len(minLatencyHeading), len(latencyHeading), len(maxLatencyHeading), len(bytesHeading), len(bytesPSHeading))
-	b.WriteString(fmt.Sprintf(headerFormatString, urlHeading, successHeading, failureHeading, minLatencyHeading, latencyHeading, maxLatencyHeading, bytesHeading, bytesPSHeading))
-	b.WriteString(fmt.Sprintf(headerFormatString, strings.Repeat("-", lenLongestUrl), strings.Repeat("-", len(successHeading)), strings.Repeat("-", len(failureHeading)), strings.Repeat("-", len(minLatencyHeading)), strings.Repeat("-", len(latencyHeading)), strings.Repeat("-", len(maxLatencyHeading)), strings.Repeat("-", len(bytesHeading)), strings.Repeat("-", len(bytesPSHeading))))
+	headerFormatString := fmt.Sprintf("%%-%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds | %%%ds\n", lenLongestUrl, len(successHeading), len(failureHeading), len(minLatencyHeading), len(latencyHeading), len(maxLatencyHeading), len(p50Heading), len(p90Heading), len(p99Heading), len(p999Heading), len(bytesHeading), len(bytesPSHeading))
+	dataFormatString := fmt.Sprintf("%%-%ds | %%%dd | %%%dd | %%%d.3f | %%%d.3f | %%%d.3f | %%%d.3f | %%%d.3f | %%%d.3f | %%%d.3f | %%%dd | %%%d.3f\n", lenLongestUrl, len(successHeading), len(failureHeading), len(minLatencyHeading), len(latencyHeading), len(maxLatencyHeading), len(p50Heading), len(p90Heading), len(p99Heading), len(p999Heading), len(bytesHeading), len(bytesPSHeading))
+	b.WriteString(fmt.Sprintf(headerFormatString, urlHeading, successHeading, failureHeading, minLatencyHeading, latencyHeading, maxLatencyHeading, p50Heading, p90Heading, p99Heading, p999Heading, bytesHeading, bytesPSHeading))
+	b.WriteString(fmt.Sprintf(headerFormatString, strings.Repeat("-", lenLongestUrl), strings.Repeat("-", len(successHeading)), strings.Repeat("-", len(failureHeading)), strings.Repeat("-", len(minLatencyHeading)), strings.Repeat("-", len(latencyHeading)), strings.Repeat("-", len(maxLatencyHeading)), strings.Repeat("-", len(p50Heading)), strings.Repeat("-", len(p90Heading)), strings.Repeat("-", len(p99Heading)), strings.Repeat("-", len(p999Heading)), strings.Repeat("-", len(bytesHeading)), strings.Repeat("-", len(bytesPSHeading))))
 	urls := maps.Keys(r.ResultsByUrl)
 	sort.Strings(urls)
 	for _, u := range urls {
@@ -203,12 +619,156 @@ func (r *StressResult) String() string {
 				ur.Successes.minLatencyMillis(),
 				ur.Successes.averageLatencyMillis(),
 				ur.Successes.maxLatencyMillis(),
+				ur.Successes.p50LatencyMillis(),
+				ur.Successes.p90LatencyMillis(),
+				ur.Successes.p99LatencyMillis(),
+				ur.Successes.p999LatencyMillis(),
 				ur.Successes.TotalBytesReceived/numSucessfulCalls,
 				float64(ur.Successes.TotalBytesReceived)/successMillis))
 	}
 	return b.String()
 }
 
+// aggregateResultJSON is the JSON representation of an AggregateResult. It reports computed
+// percentiles rather than the internal histogram, since the bucket boundaries are an
+// implementation detail.
+type aggregateResultJSON struct {
+	NumCalls                int64   `json:"numCalls"`
+	TotalBytesReceived      int64   `json:"totalBytesReceived"`
+	MinLatencyMillis        float64 `json:"minLatencyMillis"`
+	AvgLatencyMillis        float64 `json:"avgLatencyMillis"`
+	MaxLatencyMillis        float64 `json:"maxLatencyMillis"`
+	P50LatencyMillis        float64 `json:"p50LatencyMillis"`
+	P90LatencyMillis        float64 `json:"p90LatencyMillis"`
+	P99LatencyMillis        float64 `json:"p99LatencyMillis"`
+	P999LatencyMillis       float64 `json:"p999LatencyMillis"`
+	NumDropped              int64   `json:"numDropped"`
+	NumRetries              int64   `json:"numRetries"`
+	TotalRetryBackoffMillis float64 `json:"totalRetryBackoffMillis"`
+}
+
+// toJSON converts r to its JSON representation, substituting computed percentiles for the
+// internal histogram.
+func (r *AggregateResult) toJSON() aggregateResultJSON {
+	return aggregateResultJSON{
+		NumCalls:                r.NumCalls,
+		TotalBytesReceived:      r.TotalBytesReceived,
+		MinLatencyMillis:        r.minLatencyMillis(),
+		AvgLatencyMillis:        r.averageLatencyMillis(),
+		MaxLatencyMillis:        r.maxLatencyMillis(),
+		P50LatencyMillis:        r.p50LatencyMillis(),
+		P90LatencyMillis:        r.p90LatencyMillis(),
+		P99LatencyMillis:        r.p99LatencyMillis(),
+		P999LatencyMillis:       r.p999LatencyMillis(),
+		NumDropped:              r.NumDropped,
+		NumRetries:              r.NumRetries,
+		TotalRetryBackoffMillis: toMillisAtMicroPrecision(r.TotalRetryBackoff),
+	}
+}
+
+// resultWithValidityJSON is the JSON representation of a ResultWithValidity.
+type resultWithValidityJSON struct {
+	Successes aggregateResultJSON `json:"successes"`
+	Failures  aggregateResultJSON `json:"failures"`
+}
+
+// stressResultJSON is the JSON representation of a StressResult.
+type stressResultJSON struct {
+	Concurrency  int                               `json:"concurrency"`
+	StageStart   time.Time                         `json:"stageStart"`
+	StageEnd     time.Time                         `json:"stageEnd"`
+	ResultsByUrl map[string]resultWithValidityJSON `json:"resultsByUrl"`
+}
+
+// MarshalJSON reports one record per URL with computed latency percentiles, plus the stage's
+// concurrency level and wall-clock start/end.
+func (r *StressResult) MarshalJSON() ([]byte, error) {
+	resultsByUrl := make(map[string]resultWithValidityJSON, len(r.ResultsByUrl))
+	for u, rv := range r.ResultsByUrl {
+		resultsByUrl[u] = resultWithValidityJSON{
+			Successes: rv.Successes.toJSON(),
+			Failures:  rv.Failures.toJSON(),
+		}
+	}
+	return json.Marshal(stressResultJSON{
+		Concurrency:  r.Concurrency,
+		StageStart:   r.StageStart,
+		StageEnd:     r.StageEnd,
+		ResultsByUrl: resultsByUrl,
+	})
+}
+
+// csvHeader lists the per-URL CSV columns written by WriteCSVRows.
+var csvHeader = []string{
+	"request", "concurrency", "stage_start", "stage_end",
+	"success_count", "failure_count",
+	"success_min_latency_ms", "success_avg_latency_ms", "success_max_latency_ms",
+	"success_p50_latency_ms", "success_p90_latency_ms", "success_p99_latency_ms", "success_p999_latency_ms",
+	"success_bytes_per_resp", "success_bytes_per_sec",
+	"num_dropped", "num_retries", "total_retry_backoff_ms",
+}
+
+// WriteCSVHeader writes the column header row shared by every StressResult's CSV rows.
+func WriteCSVHeader(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteCSVRows writes one CSV row per URL, in the column order given by WriteCSVHeader, without
+// writing the header itself. This lets callers collect rows from multiple stages under a single
+// header.
+func (r *StressResult) WriteCSVRows(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	urls := maps.Keys(r.ResultsByUrl)
+	sort.Strings(urls)
+	for _, u := range urls {
+		ur := r.ResultsByUrl[u]
+		numSucessfulCalls := ur.Successes.NumCalls
+		if numSucessfulCalls == 0 {
+			numSucessfulCalls = 1
+		}
+		successMillis := toMillisAtMicroPrecision(ur.Successes.TotalLatency)
+		row := []string{
+			u,
+			strconv.Itoa(r.Concurrency),
+			r.StageStart.Format(time.RFC3339Nano),
+			r.StageEnd.Format(time.RFC3339Nano),
+			strconv.FormatInt(ur.Successes.NumCalls, 10),
+			strconv.FormatInt(ur.Failures.NumCalls, 10),
+			fmt.Sprintf("%.3f", ur.Successes.minLatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.averageLatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.maxLatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.p50LatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.p90LatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.p99LatencyMillis()),
+			fmt.Sprintf("%.3f", ur.Successes.p999LatencyMillis()),
+			strconv.FormatInt(ur.Successes.TotalBytesReceived/numSucessfulCalls, 10),
+			fmt.Sprintf("%.3f", float64(ur.Successes.TotalBytesReceived)/successMillis*1000),
+			strconv.FormatInt(ur.Failures.NumDropped, 10),
+			strconv.FormatInt(ur.Successes.NumRetries+ur.Failures.NumRetries, 10),
+			fmt.Sprintf("%.3f", toMillisAtMicroPrecision(ur.Successes.TotalRetryBackoff+ur.Failures.TotalRetryBackoff)),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteCSV writes this StressResult as a self-contained CSV document: a header row followed by
+// one row per URL.
+func (r *StressResult) WriteCSV(w io.Writer) error {
+	if err := WriteCSVHeader(w); err != nil {
+		return err
+	}
+	return r.WriteCSVRows(w)
+}
+
 func newStressResult() *StressResult {
 	return &StressResult{
 		ResultsByUrl: make(map[string]*ResultWithValidity),
@@ -228,6 +788,15 @@ func (r *StressResult) add(url string, toAdd urlResult) {
 	}
 }
 
+func (r *StressResult) addDropped(url string) {
+	rv, isPresent := r.ResultsByUrl[url]
+	if !isPresent {
+		rv = &ResultWithValidity{}
+		r.ResultsByUrl[url] = rv
+	}
+	rv.Failures.NumDropped += 1
+}
+
 func (r *StressResult) merge(other *StressResult) {
 	for u, orv := range other.ResultsByUrl {
 		if rv, isPresent := r.ResultsByUrl[u]; isPresent {
@@ -253,6 +822,12 @@ func (r *AggregateResult) merge(other *AggregateResult) {
 	if other.MinLatency < r.MinLatency || r.MinLatency == 0 {
 		r.MinLatency = other.MinLatency
 	}
+	r.NumDropped += other.NumDropped
+	r.NumRetries += other.NumRetries
+	r.TotalRetryBackoff += other.TotalRetryBackoff
+	for i, c := range other.latencyHistogram {
+		r.latencyHistogram[i] += c
+	}
 }
 
 func (r *AggregateResult) add(toAdd *urlResult) {
@@ -265,6 +840,9 @@ func (r *AggregateResult) add(toAdd *urlResult) {
 	if toAdd.latency < r.MinLatency || r.MinLatency == 0 {
 		r.MinLatency = toAdd.latency
 	}
+	r.NumRetries += toAdd.numRetries
+	r.TotalRetryBackoff += toAdd.retryBackoff
+	r.latencyHistogram[latencyHistBucket(toAdd.latency)] += 1
 }
 
 func (r *AggregateResult) minLatencyMillis() float64 {
@@ -279,6 +857,84 @@ func (r *AggregateResult) averageLatencyMillis() float64 {
 	return toMillisAtMicroPrecision(r.TotalLatency) / float64(r.NumCalls)
 }
 
+// p50LatencyMillis returns the 50th percentile latency, in milliseconds.
+func (r *AggregateResult) p50LatencyMillis() float64 {
+	return r.percentileLatencyMillis(0.5)
+}
+
+// p90LatencyMillis returns the 90th percentile latency, in milliseconds.
+func (r *AggregateResult) p90LatencyMillis() float64 {
+	return r.percentileLatencyMillis(0.9)
+}
+
+// p99LatencyMillis returns the 99th percentile latency, in milliseconds.
+func (r *AggregateResult) p99LatencyMillis() float64 {
+	return r.percentileLatencyMillis(0.99)
+}
+
+// p999LatencyMillis returns the 99.9th percentile latency, in milliseconds.
+func (r *AggregateResult) p999LatencyMillis() float64 {
+	return r.percentileLatencyMillis(0.999)
+}
+
+// percentileLatencyMillis returns the latency, in milliseconds, below which the given fraction
+// (0, 1] of requests fall, estimated from the latency histogram. The estimate is clamped to the
+// true observed maximum latency, since a bucket's upper bound can otherwise overstate it whenever
+// the top occupied bucket isn't filled all the way to its boundary.
+func (r *AggregateResult) percentileLatencyMillis(fraction float64) float64 {
+	if r.NumCalls == 0 {
+		return 0
+	}
+	maxMillis := r.maxLatencyMillis()
+	target := int64(math.Ceil(fraction * float64(r.NumCalls)))
+	if target < 1 {
+		target = 1
+	}
+	var cumulative int64
+	for i, c := range r.latencyHistogram {
+		cumulative += c
+		if cumulative >= target {
+			return math.Min(float64(latencyHistBucketUpperBoundMicros(i))/1000.0, maxMillis)
+		}
+	}
+	return maxMillis
+}
+
+// latencyHistBucket returns the histogram bucket index that d falls into.
+func latencyHistBucket(d time.Duration) int {
+	micros := d.Microseconds()
+	if micros < latencyHistMinMicros {
+		micros = latencyHistMinMicros
+	}
+	power := int(math.Log2(float64(micros) / float64(latencyHistMinMicros)))
+	if power < 0 {
+		power = 0
+	}
+	if power >= latencyHistNumPowers {
+		power = latencyHistNumPowers - 1
+	}
+	rangeStart := int64(latencyHistMinMicros) << power
+	rangeEnd := int64(latencyHistMinMicros) << (power + 1)
+	subBucket := int(float64(latencyHistSubBuckets) * float64(micros-rangeStart) / float64(rangeEnd-rangeStart))
+	if subBucket < 0 {
+		subBucket = 0
+	}
+	if subBucket >= latencyHistSubBuckets {
+		subBucket = latencyHistSubBuckets - 1
+	}
+	return power*latencyHistSubBuckets + subBucket
+}
+
+// latencyHistBucketUpperBoundMicros returns the upper bound, in microseconds, of the bucket at
+// the given index.
+func latencyHistBucketUpperBoundMicros(bucket int) int64 {
+	power := bucket / latencyHistSubBuckets
+	sub := bucket % latencyHistSubBuckets
+	rangeStart := int64(latencyHistMinMicros) << power
+	rangeEnd := int64(latencyHistMinMicros) << (power + 1)
+	return rangeStart + (rangeEnd-rangeStart)*int64(sub+1)/latencyHistSubBuckets
+}
+
 func toMillisAtMicroPrecision(d time.Duration) float64 {
 	return float64(d.Microseconds()) / 1000.0
 }
@@ -302,48 +958,141 @@ func (t *Tester) fetchRandomUrls(ctx context.Context, concurrency int, rc chan S
 			break
 		}
 
-		u := t.randomURL()
-		r, err := t.fetchAndVerifyUrl(u, concurrency)
-		if err != nil {
-			rc <- StressResult{}
-			return err
-		}
-		result.add(u, r)
+		spec := t.randomSpec()
+		r := t.fetchAndVerifyUrl(spec, concurrency)
+		result.add(spec.key(), r)
 	}
 
 	rc <- *result
 	return nil
 }
 
-func (t *Tester) randomURL() string {
-	n := len(t.urls)
-	i := rand.Int() % n
-	return t.urls[i]
+// randomSpec picks a spec at random, weighted by RequestSpec.Weight, using a cumulative-weights
+// binary search so the hot path stays allocation-free and O(log n).
+func (t *Tester) randomSpec() *RequestSpec {
+	r := rand.Float64() * t.totalWeight
+	i := sort.Search(len(t.cumWeights), func(i int) bool { return t.cumWeights[i] > r })
+	if i >= len(t.specs) {
+		i = len(t.specs) - 1
+	}
+	return &t.specs[i]
 }
 
-func (t *Tester) fetchAndVerifyUrl(u string, concurrency int) (urlResult, error) {
+// fetchAndVerifyUrl fetches spec and measures its latency from when the request actually started
+// to when the final attempt completes, backoff sleeping and all, matching what a caller waiting
+// on the request would observe. Like fetchAndVerifyUrlSince, transport and fault-injected
+// failures are reported as an invalid result rather than returned, since a single dropped request
+// should not abort the whole stage.
+func (t *Tester) fetchAndVerifyUrl(spec *RequestSpec, concurrency int) urlResult {
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
-	prepRequest(req, u, concurrency)
+	prepRequest(req, spec, concurrency)
 	start := time.Now()
-	err := t.client.Do(req, resp)
+	numRetries, retryBackoff, err := t.doWithRetry(req, resp)
 	end := time.Now()
+	exp := t.responseByKey[spec.key()]
 	if err != nil {
-		return urlResult{}, err
+		r := urlResult{isValid: false, latency: end.Sub(start), numRetries: numRetries, retryBackoff: retryBackoff}
+		exp.record(t.metrics != nil, r)
+		return r
 	}
 
-	exp := t.responseByUrl[u]
 	body := resp.Body()
-	return urlResult{
+	r := urlResult{
 		isValid:       exp.isValid(resp.StatusCode(), body),
 		bytesReceived: len(body),
 		latency:       end.Sub(start),
-	}, nil
+		numRetries:    numRetries,
+		retryBackoff:  retryBackoff,
+	}
+	exp.record(t.metrics != nil, r)
+	return r
 }
 
-func prepRequest(req *fasthttp.Request, url string, concurrency int) {
-	req.SetRequestURI(url)
+// fetchAndVerifyUrlSince fetches spec and measures latency from since rather than from when the
+// request actually started, so that queueing delay in an open-model load generator is reflected
+// in the result. Like fetchAndVerifyUrl, transport errors are reported as an invalid result
+// rather than returned, since each scheduled request in that model is independent and a single
+// failure should not abort the run.
+func (t *Tester) fetchAndVerifyUrlSince(spec *RequestSpec, concurrency int, since time.Time) urlResult {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	prepRequest(req, spec, concurrency)
+	exp := t.responseByKey[spec.key()]
+	numRetries, retryBackoff, err := t.doWithRetry(req, resp)
+	end := time.Now()
+	if err != nil {
+		r := urlResult{isValid: false, latency: end.Sub(since), numRetries: numRetries, retryBackoff: retryBackoff}
+		exp.record(t.metrics != nil, r)
+		return r
+	}
+
+	body := resp.Body()
+	r := urlResult{
+		isValid:       exp.isValid(resp.StatusCode(), body),
+		bytesReceived: len(body),
+		latency:       end.Sub(since),
+		numRetries:    numRetries,
+		retryBackoff:  retryBackoff,
+	}
+	exp.record(t.metrics != nil, r)
+	return r
+}
+
+// doWithRetry performs req, retrying according to t.retryPolicy (if any) before returning the
+// final attempt's outcome. It reports how many retries were made and how long was spent
+// sleeping between them.
+func (t *Tester) doWithRetry(req *fasthttp.Request, resp *fasthttp.Response) (numRetries int64, totalBackoff time.Duration, err error) {
+	if t.retryPolicy == nil {
+		return 0, 0, t.doOnce(req, resp)
+	}
+
+	policy := t.retryPolicy
+	backoff := policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err = t.doOnce(req, resp)
+		if attempt >= policy.MaxAttempts || !policy.isRetryable(resp.StatusCode(), err) {
+			return numRetries, totalBackoff, err
+		}
+		backoff = policy.nextBackoff(backoff)
+		totalBackoff += backoff
+		numRetries++
+		time.Sleep(backoff)
+		resp.Reset()
+	}
+}
+
+// doOnce performs a single request attempt, applying fault injection (if configured) before and
+// after the real call to t.client.Do.
+func (t *Tester) doOnce(req *fasthttp.Request, resp *fasthttp.Response) error {
+	fi := t.faultInjector
+	if fi != nil && fi.shouldDropBeforeSend() {
+		return errFaultInjectedDrop
+	}
+	err := t.client.Do(req, resp)
+	if fi == nil {
+		return err
+	}
+	if d := fi.sampleLatency(); d > 0 {
+		time.Sleep(d)
+	}
+	if err == nil && fi.shouldCorruptResponse() {
+		resp.SetStatusCode(faultInjectedCorruptStatusCode)
+	}
+	return err
+}
+
+func prepRequest(req *fasthttp.Request, spec *RequestSpec, concurrency int) {
+	req.SetRequestURI(spec.URL)
 	req.Header.SetUserAgent(clientName + "-" + strconv.Itoa(concurrency))
-	req.Header.SetMethod(http.MethodGet)
+	req.Header.SetMethod(spec.Method)
 	req.Header.Add("Accept-Encoding", "gzip, deflate, br")
+	for k, v := range spec.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(spec.Body) > 0 {
+		// SetBodyRaw stores the reference without copying, unlike SetBody. This is safe because
+		// spec.Body is only ever read, never mutated, by the tester.
+		req.SetBodyRaw(spec.Body)
+	}
 }
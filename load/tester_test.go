@@ -0,0 +1,412 @@
+package load
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAggregateResultPercentileLatencyMillis(t *testing.T) {
+	r := &AggregateResult{}
+	for ms := 1; ms <= 1000; ms++ {
+		r.add(&urlResult{latency: time.Duration(ms) * time.Millisecond})
+	}
+
+	maxMillis := r.maxLatencyMillis()
+	if maxMillis != 1000 {
+		t.Fatalf("maxLatencyMillis() = %v, want 1000", maxMillis)
+	}
+
+	for _, p := range []struct {
+		name     string
+		fraction float64
+	}{
+		{"p50", 0.5},
+		{"p90", 0.9},
+		{"p99", 0.99},
+		{"p999", 0.999},
+	} {
+		if got := r.percentileLatencyMillis(p.fraction); got > maxMillis {
+			t.Errorf("%s = %v, want <= max latency %v", p.name, got, maxMillis)
+		}
+	}
+}
+
+func TestAggregateResultPercentileLatencyMillisEmpty(t *testing.T) {
+	r := &AggregateResult{}
+	if got := r.percentileLatencyMillis(0.99); got != 0 {
+		t.Errorf("percentileLatencyMillis() on empty result = %v, want 0", got)
+	}
+}
+
+func TestLatencyHistBucketMonotonic(t *testing.T) {
+	prev := -1
+	for ms := 0; ms <= 2000; ms++ {
+		b := latencyHistBucket(time.Duration(ms) * time.Millisecond)
+		if b < prev {
+			t.Fatalf("latencyHistBucket(%dms) = %d, want >= previous bucket %d", ms, b, prev)
+		}
+		prev = b
+	}
+}
+
+func TestLatencyHistBucketUpperBoundCoversDuration(t *testing.T) {
+	for micros := int64(1); micros < 1_000_000; micros += 137 {
+		d := time.Duration(micros) * time.Microsecond
+		b := latencyHistBucket(d)
+		upperMicros := latencyHistBucketUpperBoundMicros(b)
+		if micros > upperMicros {
+			t.Errorf("latencyHistBucketUpperBoundMicros(%d) = %d, want >= %d", b, upperMicros, micros)
+		}
+	}
+}
+
+func TestNextArrivalIntervalFixed(t *testing.T) {
+	mean := 50 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		if got := nextArrivalInterval(RateStyleFixed, mean); got != mean {
+			t.Errorf("nextArrivalInterval(fixed) = %v, want %v", got, mean)
+		}
+	}
+}
+
+func TestNextArrivalIntervalPoisson(t *testing.T) {
+	mean := 50 * time.Millisecond
+	var total time.Duration
+	const samples = 10000
+	for i := 0; i < samples; i++ {
+		got := nextArrivalInterval(RateStylePoisson, mean)
+		if got < 0 {
+			t.Fatalf("nextArrivalInterval(poisson) = %v, want >= 0", got)
+		}
+		total += got
+	}
+	// The exponential distribution's mean is the reciprocal of its rate parameter, and
+	// nextArrivalInterval scales a rate-1 sample by mean; over enough samples the
+	// average inter-arrival time should land close to the configured mean.
+	avg := total / samples
+	if avg < mean/2 || avg > mean*2 {
+		t.Errorf("average of %d poisson intervals = %v, want within 2x of mean %v", samples, avg, mean)
+	}
+}
+
+func TestStressAtRateValidatesArguments(t *testing.T) {
+	tester := NewTester(1)
+	if _, err := tester.StressAtRate(context.Background(), 0, 1, RateStyleFixed); err == nil {
+		t.Error("StressAtRate with requestsPerSecond=0 returned nil error, want error")
+	}
+	if _, err := tester.StressAtRate(context.Background(), 1, 0, RateStyleFixed); err == nil {
+		t.Error("StressAtRate with maxInFlight=0 returned nil error, want error")
+	}
+}
+
+func TestStressResultAddDropped(t *testing.T) {
+	r := newStressResult()
+	r.addDropped("GET /foo")
+	r.addDropped("GET /foo")
+	rv := r.ResultsByUrl["GET /foo"]
+	if rv.Failures.NumDropped != 2 {
+		t.Errorf("NumDropped = %v, want 2", rv.Failures.NumDropped)
+	}
+}
+
+func TestAggregateResultMergeSumsNumDropped(t *testing.T) {
+	a := &AggregateResult{NumDropped: 3}
+	b := &AggregateResult{NumDropped: 4}
+	a.merge(b)
+	if a.NumDropped != 7 {
+		t.Errorf("NumDropped after merge = %v, want 7", a.NumDropped)
+	}
+}
+
+func TestRetryPolicyNextBackoffStaysWithinBounds(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	prev := p.BaseDelay
+	for i := 0; i < 100; i++ {
+		next := p.nextBackoff(prev)
+		if next < p.BaseDelay || next > p.MaxDelay {
+			t.Fatalf("nextBackoff(%v) = %v, want within [%v, %v]", prev, next, p.BaseDelay, p.MaxDelay)
+		}
+		prev = next
+	}
+}
+
+func TestRetryPolicyNextBackoffDegenerateRangeReturnsBaseDelay(t *testing.T) {
+	// prev*3 <= BaseDelay whenever prev <= BaseDelay/3 (here prev == 0), giving a degenerate
+	// [lower, upper) range.
+	p := &RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	if got := p.nextBackoff(0); got != p.BaseDelay {
+		t.Errorf("nextBackoff(0) = %v, want %v", got, p.BaseDelay)
+	}
+}
+
+func TestRetryPolicyIsRetryable(t *testing.T) {
+	p := &RetryPolicy{
+		RetryableStatusCodes: map[int]bool{503: true},
+		RetryTransportErrors: true,
+	}
+	cases := []struct {
+		name       string
+		statusCode int
+		err        error
+		want       bool
+	}{
+		{"retryable status", 503, nil, true},
+		{"non-retryable status", 500, nil, false},
+		{"transport error", 0, errFaultInjectedDrop, true},
+		{"canceled context never retried", 0, context.Canceled, false},
+	}
+	for _, c := range cases {
+		if got := p.isRetryable(c.statusCode, c.err); got != c.want {
+			t.Errorf("%s: isRetryable(%v, %v) = %v, want %v", c.name, c.statusCode, c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyIsRetryableTransportErrorsDisabled(t *testing.T) {
+	p := &RetryPolicy{RetryTransportErrors: false}
+	if p.isRetryable(0, errFaultInjectedDrop) {
+		t.Error("isRetryable() = true with RetryTransportErrors disabled, want false")
+	}
+}
+
+func TestFaultInjectorErrorRateZeroNeverFires(t *testing.T) {
+	never := &FaultInjector{ErrorRate: 0}
+	for i := 0; i < 1000; i++ {
+		if never.shouldDropBeforeSend() || never.shouldCorruptResponse() {
+			t.Fatal("with ErrorRate=0, shouldDropBeforeSend/shouldCorruptResponse fired, want never")
+		}
+	}
+}
+
+func TestFaultInjectorErrorRateSplitEvenly(t *testing.T) {
+	fi := &FaultInjector{ErrorRate: 1}
+	const samples = 10000
+	var drops, corruptions int
+	for i := 0; i < samples; i++ {
+		if fi.shouldDropBeforeSend() {
+			drops++
+		}
+		if fi.shouldCorruptResponse() {
+			corruptions++
+		}
+	}
+	// Each independently fires with probability ErrorRate/2 == 0.5.
+	for name, count := range map[string]int{"shouldDropBeforeSend": drops, "shouldCorruptResponse": corruptions} {
+		if frac := float64(count) / samples; frac < 0.4 || frac > 0.6 {
+			t.Errorf("%s fired %v/%v times (%.2f), want close to 0.5", name, count, samples, frac)
+		}
+	}
+}
+
+func TestFaultInjectorSampleLatencyDisabled(t *testing.T) {
+	fi := &FaultInjector{}
+	if got := fi.sampleLatency(); got != 0 {
+		t.Errorf("sampleLatency() with no configured latency = %v, want 0", got)
+	}
+}
+
+func TestFaultInjectorSampleLatencyAroundP50(t *testing.T) {
+	fi := &FaultInjector{LatencyP50: 100 * time.Millisecond, LatencyP99: 500 * time.Millisecond}
+	const samples = 5000
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		d := fi.sampleLatency()
+		if d <= 0 {
+			t.Fatalf("sampleLatency() = %v, want > 0", d)
+		}
+		total += d
+	}
+	// A log-normal distribution's median is exp(mu) == the configured p50; its mean runs higher
+	// because of the right tail, so just check the sample average lands in the right neighborhood.
+	avg := total / samples
+	if avg < fi.LatencyP50/2 || avg > fi.LatencyP99 {
+		t.Errorf("average sampled latency = %v, want within [%v, %v]", avg, fi.LatencyP50/2, fi.LatencyP99)
+	}
+}
+
+func testStressResult() *StressResult {
+	r := newStressResult()
+	r.Concurrency = 4
+	r.StageStart = time.Unix(1000, 0)
+	r.StageEnd = time.Unix(1001, 0)
+	r.add("GET /foo", urlResult{isValid: true, bytesReceived: 100, latency: 50 * time.Millisecond})
+	r.add("GET /foo", urlResult{isValid: false, bytesReceived: 0, latency: 10 * time.Millisecond})
+	r.addDropped("GET /foo")
+	return r
+}
+
+func TestStressResultMarshalJSON(t *testing.T) {
+	r := testStressResult()
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("MarshalJSON() error: %v", err)
+	}
+
+	var got stressResultJSON
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if got.Concurrency != 4 {
+		t.Errorf("Concurrency = %v, want 4", got.Concurrency)
+	}
+	if !got.StageStart.Equal(r.StageStart) || !got.StageEnd.Equal(r.StageEnd) {
+		t.Errorf("StageStart/StageEnd = %v/%v, want %v/%v", got.StageStart, got.StageEnd, r.StageStart, r.StageEnd)
+	}
+	rv, ok := got.ResultsByUrl["GET /foo"]
+	if !ok {
+		t.Fatalf("ResultsByUrl missing key %q", "GET /foo")
+	}
+	if rv.Successes.NumCalls != 1 {
+		t.Errorf("Successes.NumCalls = %v, want 1", rv.Successes.NumCalls)
+	}
+	if rv.Failures.NumCalls != 1 {
+		t.Errorf("Failures.NumCalls = %v, want 1", rv.Failures.NumCalls)
+	}
+	if rv.Failures.NumDropped != 1 {
+		t.Errorf("Failures.NumDropped = %v, want 1", rv.Failures.NumDropped)
+	}
+	if rv.Successes.MaxLatencyMillis != 50 {
+		t.Errorf("Successes.MaxLatencyMillis = %v, want 50", rv.Successes.MaxLatencyMillis)
+	}
+}
+
+func TestStressResultWriteCSVRows(t *testing.T) {
+	r := testStressResult()
+	var buf bytes.Buffer
+	if err := r.WriteCSVRows(&buf); err != nil {
+		t.Fatalf("WriteCSVRows() error: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse written CSV: %v", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("got %v rows, want 1", len(rows))
+	}
+	row := rows[0]
+	if len(row) != len(csvHeader) {
+		t.Fatalf("row has %v columns, want %v to match csvHeader", len(row), len(csvHeader))
+	}
+	if row[0] != "GET /foo" {
+		t.Errorf("request column = %q, want %q", row[0], "GET /foo")
+	}
+	if row[4] != "1" {
+		t.Errorf("success_count column = %q, want %q", row[4], "1")
+	}
+	if row[5] != "1" {
+		t.Errorf("failure_count column = %q, want %q", row[5], "1")
+	}
+	if row[15] != "1" {
+		t.Errorf("num_dropped column = %q, want %q", row[15], "1")
+	}
+}
+
+// testerWithSpecs builds a Tester with specs and weights set directly, bypassing Init (which
+// would otherwise perform a live warm-up fetch per spec).
+func testerWithSpecs(specs []RequestSpec) *Tester {
+	tester := NewTester(1)
+	tester.specs = make([]RequestSpec, len(specs))
+	copy(tester.specs, specs)
+	tester.cumWeights = make([]float64, len(tester.specs))
+	for i := range tester.specs {
+		if tester.specs[i].Weight <= 0 {
+			tester.specs[i].Weight = 1
+		}
+		tester.totalWeight += tester.specs[i].Weight
+		tester.cumWeights[i] = tester.totalWeight
+	}
+	return tester
+}
+
+func TestTesterRandomSpecRespectsWeights(t *testing.T) {
+	tester := testerWithSpecs([]RequestSpec{
+		{URL: "heavy", Weight: 9},
+		{URL: "light", Weight: 1},
+	})
+	const samples = 10000
+	counts := make(map[string]int)
+	for i := 0; i < samples; i++ {
+		counts[tester.randomSpec().URL]++
+	}
+	heavyFrac := float64(counts["heavy"]) / samples
+	if heavyFrac < 0.8 || heavyFrac > 0.95 {
+		t.Errorf("heavy spec (weight 9 of 10) chosen %.2f of the time, want close to 0.9", heavyFrac)
+	}
+}
+
+func TestHandlesForResolvesPerUrlLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tester := NewTester(1)
+	tester.metrics = newTesterMetrics(registry)
+
+	handles := tester.handlesFor(&RequestSpec{URL: "/foo", Method: http.MethodGet})
+	handles.successes.Inc()
+	handles.failures.Inc()
+	handles.failures.Inc()
+	handles.bytes.Add(100)
+	handles.duration.Observe(0.25)
+
+	if got := testutil.ToFloat64(tester.metrics.requestsTotal.WithLabelValues("/foo", "success")); got != 1 {
+		t.Errorf("requests_total{outcome=success} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tester.metrics.requestsTotal.WithLabelValues("/foo", "failure")); got != 2 {
+		t.Errorf("requests_total{outcome=failure} = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(tester.metrics.bytesReceivedTotal.WithLabelValues("/foo")); got != 100 {
+		t.Errorf("bytes_received_total = %v, want 100", got)
+	}
+}
+
+func TestExpectedResponseDataRecordUpdatesMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tester := NewTester(1)
+	tester.metrics = newTesterMetrics(registry)
+	exp := &expectedResponseData{metrics: tester.handlesFor(&RequestSpec{URL: "/foo"})}
+
+	exp.record(true, urlResult{isValid: true, bytesReceived: 10, latency: 5 * time.Millisecond})
+	exp.record(true, urlResult{isValid: false, bytesReceived: 20, latency: 10 * time.Millisecond})
+
+	if got := testutil.ToFloat64(tester.metrics.requestsTotal.WithLabelValues("/foo", "success")); got != 1 {
+		t.Errorf("successes = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tester.metrics.requestsTotal.WithLabelValues("/foo", "failure")); got != 1 {
+		t.Errorf("failures = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tester.metrics.bytesReceivedTotal.WithLabelValues("/foo")); got != 30 {
+		t.Errorf("bytes = %v, want 30", got)
+	}
+}
+
+func TestExpectedResponseDataRecordNoopWhenMetricsDisabled(t *testing.T) {
+	exp := &expectedResponseData{}
+	// Must not panic even though exp.metrics is the zero value, since metricsEnabled is false.
+	exp.record(false, urlResult{isValid: true})
+}
+
+func TestRecordStageMetricsSetsGauges(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tester := NewTester(1)
+	tester.metrics = newTesterMetrics(registry)
+
+	results := newStressResult()
+	results.add("/foo", urlResult{isValid: true})
+	results.add("/foo", urlResult{isValid: true})
+	results.add("/foo", urlResult{isValid: false})
+	tester.recordStageMetrics(8, results)
+
+	if got := testutil.ToFloat64(tester.metrics.concurrency); got != 8 {
+		t.Errorf("concurrency gauge = %v, want 8", got)
+	}
+	if got := testutil.ToFloat64(tester.metrics.errorRate); got != 0.5 {
+		t.Errorf("error_rate gauge = %v, want 0.5", got)
+	}
+}
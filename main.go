@@ -3,15 +3,22 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/MorganR/http-load-tester/load"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const pathSeparator = "\\"
@@ -19,12 +26,34 @@ const pathSeparator = "\\"
 var (
 	host           = flag.String("host", "", "The host to connect to. Must include the scheme.")
 	paths          = flag.String("paths", "", "Backslash (\\) separated paths to query.")
-	pathsFile      = flag.String("paths_file", "", "The file to read URL paths from, one per line.")
+	pathsFile      = flag.String("paths_file", "", "The file to read request specs from, one per line. Each line is either a bare path (GET, weight 1) or a tab separated \"weight\\tMETHOD\\tpath[\\tbodyRef]\", where bodyRef is a path to a file to use as the request body.")
 	maxConcurrency = flag.Int("c", 10, "Max concurrency to use in the load test.")
-	rampStyle      = flag.String("ramp_style", "doubling", "Determines how concurrency ramps. Either 'linear' or 'doubling'.")
+	rampStyle      = flag.String("ramp_style", "doubling", "Determines how concurrency (or, in rate mode, request rate) ramps. Either 'linear' or 'doubling'.")
 	linearRampStep = flag.Int("linear_ramp_step", 5, "The amount that concurrency increases at each stage. Only applies if ramp_style is linear.")
 	stageDelay     = flag.Duration("stage_delay", 10*time.Second, "How long to send requests at each degree of concurrency.")
 	errorThreshold = flag.Float64("err_threshold", 0.05, "The error rate at which the stress test will be canceled, even if the max concurrency has not yet been reached.")
+
+	mode = flag.String("mode", "concurrency", "The load generation mode to use. Either 'concurrency' for a closed-loop concurrency ramp, or 'rate' for an open-model request rate ramp.")
+
+	rateStyle       = flag.String("rate_style", "fixed", "Determines how request issue times are distributed in rate mode. Either 'fixed' or 'poisson'.")
+	rateRps         = flag.Float64("rate_rps", 100, "Max requests per second to use in rate mode.")
+	linearRateStep  = flag.Float64("linear_rate_step", 50, "The amount that the request rate increases at each stage in rate mode. Only applies if ramp_style is linear.")
+	rateMaxInFlight = flag.Int("rate_max_in_flight", 50, "Max number of requests serviced concurrently in rate mode. Requests issued beyond this bound are dropped.")
+
+	retryMaxAttempts     = flag.Int("retry_max_attempts", 1, "Max number of attempts per request, including the first. Values <= 1 disable retries.")
+	retryBaseDelay       = flag.Duration("retry_base_delay", 100*time.Millisecond, "The minimum backoff delay before a retry.")
+	retryMaxDelay        = flag.Duration("retry_max_delay", 5*time.Second, "The maximum backoff delay before a retry.")
+	retryStatusCodes     = flag.String("retry_status_codes", "429,502,503,504", "Comma separated response status codes that should be retried.")
+	retryTransportErrors = flag.Bool("retry_transport_errors", true, "Whether to retry transport-level errors (e.g. connection refused, EOF, deadline exceeded). Only applies if retry_max_attempts > 1.")
+
+	injectErrorRate  = flag.Float64("inject_error_rate", 0, "Error rate [0, 1] for regression-testing this tool against an unstable network: each request attempt is dropped with probability rate/2, and a completed attempt has its response corrupted with a further probability of rate/2. 0 injects no errors.")
+	injectLatencyP50 = flag.Duration("inject_latency_p50", 0, "Median extra latency to inject into each request attempt. Only applies if fault injection is enabled.")
+	injectLatencyP99 = flag.Duration("inject_latency_p99", 0, "99th percentile extra latency to inject into each request attempt. Only applies if fault injection is enabled.")
+
+	outputFormat = flag.String("output_format", "text", "Output format for stress results. One of 'text', 'json', 'csv', or 'ndjson'.")
+	outputFile   = flag.String("output_file", "", "File to write 'json', 'csv', or 'ndjson' output to. Defaults to stdout. Ignored for 'text' output, which always logs via the standard logger.")
+
+	metricsAddr = flag.String("metrics_addr", "", "If set, serve Prometheus metrics at http://<metrics_addr>/metrics, so a running stress test can be observed live rather than only after each stage completes.")
 )
 
 const absoluteMaxConcurrency = 512
@@ -36,16 +65,16 @@ func main() {
 		log.Fatal("A value for host must be provided.")
 	}
 
-	urls, err := constructURLs(*host, strings.Split(*paths, pathSeparator))
+	specs, err := constructSpecs(*host, strings.Split(*paths, pathSeparator))
 	if err != nil {
 		log.Fatalf("Failed to construct urls from paths flag. Error: %v", err.Error())
 	}
 	if *pathsFile != "" {
-		moreUrls, err := loadAndValidateURLsFromFile(*host, *pathsFile)
+		moreSpecs, err := loadAndValidateSpecsFromFile(*host, *pathsFile)
 		if err != nil {
 			log.Fatalf("Failed to load urls: %v", err.Error())
 		}
-		urls = append(urls, moreUrls...)
+		specs = append(specs, moreSpecs...)
 	}
 	concurrencyCap := *maxConcurrency
 	if concurrencyCap > absoluteMaxConcurrency {
@@ -55,23 +84,112 @@ func main() {
 	if *errorThreshold <= 0 || *errorThreshold > 1.0 {
 		log.Fatalf("err_threshold must be > 0 and <= 1.0. Received %.3f", *errorThreshold)
 	}
+	switch *outputFormat {
+	case "text", "json", "csv", "ndjson":
+		// Valid.
+	default:
+		log.Fatalf("output_format must be set to a valid value (text, json, csv, or ndjson). Received: %v", *outputFormat)
+	}
+
+	var testerOpts []load.TesterOption
+	if *retryMaxAttempts > 1 {
+		statusCodes, err := parseRetryStatusCodes(*retryStatusCodes)
+		if err != nil {
+			log.Fatalf("Failed to parse retry_status_codes: %v", err.Error())
+		}
+		testerOpts = append(testerOpts, load.WithRetryPolicy(load.RetryPolicy{
+			MaxAttempts:          *retryMaxAttempts,
+			BaseDelay:            *retryBaseDelay,
+			MaxDelay:             *retryMaxDelay,
+			RetryableStatusCodes: statusCodes,
+			RetryTransportErrors: *retryTransportErrors,
+		}))
+	}
+
+	if *injectErrorRate > 0 || *injectLatencyP50 > 0 || *injectLatencyP99 > 0 {
+		testerOpts = append(testerOpts, load.WithFaultInjector(load.FaultInjector{
+			ErrorRate:  *injectErrorRate,
+			LatencyP50: *injectLatencyP50,
+			LatencyP99: *injectLatencyP99,
+		}))
+	}
 
-	tester := load.NewTester(concurrencyCap)
-	err = tester.Init(urls)
+	if *metricsAddr != "" {
+		testerOpts = append(testerOpts, load.WithMetrics(prometheus.DefaultRegisterer))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Fatalf("Metrics server failed: %v", err.Error())
+			}
+		}()
+		log.Printf("Serving Prometheus metrics at http://%v/metrics", *metricsAddr)
+	}
+
+	tester := load.NewTester(concurrencyCap, testerOpts...)
+	err = tester.Init(specs)
 	if err != nil {
 		log.Fatalf("Failed to init the tester: %v", err.Error())
 	}
 
+	sink, err := newOutputSink(*outputFormat, *outputFile)
+	if err != nil {
+		log.Fatalf("Failed to open output_file: %v", err.Error())
+	}
+
+	switch *mode {
+	case "rate":
+		runRateRamp(tester, sink)
+	case "concurrency":
+		runConcurrencyRamp(concurrencyCap, tester, sink)
+	default:
+		log.Fatalf("mode must be set to a valid value (concurrency or rate). Received: %v", *mode)
+	}
+
+	if err := sink.finalize(); err != nil {
+		log.Fatalf("Failed to write %v output: %v", *outputFormat, err.Error())
+	}
+}
+
+func runConcurrencyRamp(concurrencyCap int, tester *load.Tester, sink *outputSink) {
 	concurrency := 2
 	lastConcurrency := 1
 	shouldContinue := true
 	for ; concurrency <= concurrencyCap && shouldContinue; concurrency = increaseConcurrency(concurrency) {
-		shouldContinue = stressTestWithConcurrency(concurrency, tester)
+		shouldContinue = stressTestWithConcurrency(concurrency, tester, sink)
 		lastConcurrency = concurrency
 	}
 	if shouldContinue && lastConcurrency != concurrencyCap {
 		// Run one more at the cap, if the cap is not a multiple of 2
-		stressTestWithConcurrency(concurrencyCap, tester)
+		stressTestWithConcurrency(concurrencyCap, tester, sink)
+	}
+}
+
+func runRateRamp(tester *load.Tester, sink *outputSink) {
+	style := parseRateStyle(*rateStyle)
+
+	rps := 2.0
+	lastRps := 1.0
+	shouldContinue := true
+	for ; rps <= *rateRps && shouldContinue; rps = increaseRate(rps) {
+		shouldContinue = stressTestAtRate(rps, style, tester, sink)
+		lastRps = rps
+	}
+	if shouldContinue && lastRps != *rateRps {
+		// Run one more at the cap, if the cap is not reached exactly by the ramp.
+		stressTestAtRate(*rateRps, style, tester, sink)
+	}
+}
+
+func parseRateStyle(s string) load.RateStyle {
+	switch s {
+	case "fixed":
+		return load.RateStyleFixed
+	case "poisson":
+		return load.RateStylePoisson
+	default:
+		log.Fatalf("rate_style must be set to a valid value (fixed or poisson). Received: %v", s)
+		return load.RateStyleFixed
 	}
 }
 
@@ -87,15 +205,34 @@ func increaseConcurrency(current int) int {
 	}
 }
 
+func increaseRate(current float64) float64 {
+	switch *rampStyle {
+	case "linear":
+		return current + *linearRateStep
+	case "doubling":
+		return current + current
+	default:
+		log.Fatalf("ramp_style must be set to a valid value (linear or doubling). Received: %v", *rampStyle)
+		return 1
+	}
+}
+
 // Returns true if the test should continue.
-func stressTestWithConcurrency(concurrency int, tester *load.Tester) bool {
+func stressTestWithConcurrency(concurrency int, tester *load.Tester, sink *outputSink) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), *stageDelay)
 	result, err := tester.Stress(ctx, concurrency)
 	if err != nil {
 		log.Fatalf("Stress test failed at concurrency %d: %v", concurrency, err.Error())
 	}
 	cancel()
-	log.Printf("Result at concurrency %v\n%v\nDetails:\n%s", concurrency, result.SummaryString(), result)
+	if *outputFormat == "text" {
+		log.Printf("Result at concurrency %v\n%v\nDetails:\n%s", concurrency, result.SummaryString(), result)
+	} else {
+		log.Printf("Completed stage at concurrency %v", concurrency)
+		if err := sink.record(result); err != nil {
+			log.Fatalf("Failed to write %v output: %v", *outputFormat, err.Error())
+		}
+	}
 	numSuccess := int64(0)
 	numFailures := int64(0)
 	for _, r := range result.ResultsByUrl {
@@ -114,35 +251,204 @@ func stressTestWithConcurrency(concurrency int, tester *load.Tester) bool {
 	return true
 }
 
-func constructURLs(host string, paths []string) ([]string, error) {
-	urls := make([]string, 0, len(paths))
+// Returns true if the test should continue.
+func stressTestAtRate(rps float64, style load.RateStyle, tester *load.Tester, sink *outputSink) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *stageDelay)
+	result, err := tester.StressAtRate(ctx, rps, *rateMaxInFlight, style)
+	if err != nil {
+		log.Fatalf("Stress test failed at rate %.3f: %v", rps, err.Error())
+	}
+	cancel()
+	if *outputFormat == "text" {
+		log.Printf("Result at rate %.3f req/s\n%v\nDetails:\n%s", rps, result.SummaryString(), result)
+	} else {
+		log.Printf("Completed stage at rate %.3f req/s", rps)
+		if err := sink.record(result); err != nil {
+			log.Fatalf("Failed to write %v output: %v", *outputFormat, err.Error())
+		}
+	}
+	numSuccess := int64(0)
+	numFailures := int64(0)
+	numDropped := int64(0)
+	for _, r := range result.ResultsByUrl {
+		numSuccess += r.Successes.NumCalls
+		numFailures += r.Failures.NumCalls
+		numDropped += r.Failures.NumDropped
+	}
+	if numSuccess == 0 {
+		log.Printf("No successful calls at rate %.3f req/s", rps)
+		return false
+	}
+	// Dropped requests never reached the wire, but they're just as strong a saturation signal
+	// as outright failures, so they count toward the error rate too.
+	errRate := float64(numFailures+numDropped) / float64(numSuccess)
+	if errRate > *errorThreshold {
+		log.Printf("Error rate over threshold at rate %.3f req/s. Rate: %.3f (%d dropped)", rps, errRate, numDropped)
+		return false
+	}
+	return true
+}
+
+// outputSink collects stage results according to -output_format and writes them to -output_file.
+// The 'ndjson' format streams one JSON record per stage as soon as it's recorded; 'json' and
+// 'csv' accumulate all stages and are only written out by finalize, once the full run completes.
+type outputSink struct {
+	format       string
+	w            io.Writer
+	stageResults []*load.StressResult
+}
+
+func newOutputSink(format, file string) (*outputSink, error) {
+	sink := &outputSink{format: format, w: os.Stdout}
+	if format == "text" {
+		return sink, nil
+	}
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		sink.w = f
+	}
+	return sink, nil
+}
+
+func (s *outputSink) record(result *load.StressResult) error {
+	switch s.format {
+	case "ndjson":
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(append(data, '\n'))
+		return err
+	case "json", "csv":
+		s.stageResults = append(s.stageResults, result)
+	}
+	return nil
+}
+
+func (s *outputSink) finalize() error {
+	switch s.format {
+	case "json":
+		data, err := json.Marshal(s.stageResults)
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(append(data, '\n'))
+		return err
+	case "csv":
+		if err := load.WriteCSVHeader(s.w); err != nil {
+			return err
+		}
+		for _, r := range s.stageResults {
+			if err := r.WriteCSVRows(s.w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseRetryStatusCodes(s string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	if s == "" {
+		return codes, nil
+	}
+	for _, c := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q: %v", c, err.Error())
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+func constructSpecs(host string, paths []string) ([]load.RequestSpec, error) {
+	specs := make([]load.RequestSpec, 0, len(paths))
 	for _, p := range paths {
 		u, err := url.Parse(host + p)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse URL; %v", err.Error())
 		}
-		urls = append(urls, u.String())
+		specs = append(specs, load.RequestSpec{URL: u.String(), Method: http.MethodGet, Weight: 1})
 	}
-	return urls, nil
+	return specs, nil
 }
 
-func loadAndValidateURLsFromFile(host, filename string) ([]string, error) {
+// loadAndValidateSpecsFromFile reads one request spec per line from filename. Each line is
+// either a bare path (for backward compatibility, treated as a GET with weight 1) or a tab
+// separated line of the form "weight\tMETHOD\tpath[\tbodyRef]", where bodyRef is the path to a
+// file whose contents are used as the request body. Each distinct bodyRef is read from disk at
+// most once, and its contents are shared by every spec that references it.
+func loadAndValidateSpecsFromFile(host, filename string) ([]load.RequestSpec, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %v: %v", filename, err.Error())
 	}
+	defer f.Close()
+
+	bodiesByRef := make(map[string][]byte)
 	s := bufio.NewScanner(f)
-	urls := make([]string, 0)
+	specs := make([]load.RequestSpec, 0)
 	for s.Scan() {
 		l := s.Text()
-		u, err := url.Parse(host + l)
+		if l == "" {
+			continue
+		}
+		spec, err := parseSpecLine(l)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse line %q: %v", l, err.Error())
+		}
+		u, err := url.Parse(host + spec.URL)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse url %v. Error: %v", l, err.Error())
+			return nil, fmt.Errorf("could not parse url %v. Error: %v", spec.URL, err.Error())
+		}
+		spec.URL = u.String()
+		if spec.bodyRef != "" {
+			body, ok := bodiesByRef[spec.bodyRef]
+			if !ok {
+				body, err = os.ReadFile(spec.bodyRef)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read body file %v: %v", spec.bodyRef, err.Error())
+				}
+				bodiesByRef[spec.bodyRef] = body
+			}
+			spec.Body = body
 		}
-		urls = append(urls, u.String())
+		specs = append(specs, spec.RequestSpec)
 	}
 	if s.Err() != nil {
 		return nil, s.Err()
 	}
-	return urls, nil
+	return specs, nil
+}
+
+// specLine is a load.RequestSpec plus the raw bodyRef parsed from a paths file line, before the
+// referenced file has been read.
+type specLine struct {
+	load.RequestSpec
+	bodyRef string
+}
+
+// parseSpecLine parses a single paths file line, either a bare path (backward compatible GET
+// with weight 1) or a tab separated "weight\tMETHOD\tpath[\tbodyRef]" line.
+func parseSpecLine(line string) (specLine, error) {
+	parts := strings.Split(line, "\t")
+	if len(parts) == 1 {
+		return specLine{RequestSpec: load.RequestSpec{URL: parts[0], Method: http.MethodGet, Weight: 1}}, nil
+	}
+	if len(parts) != 3 && len(parts) != 4 {
+		return specLine{}, errors.New("expected a bare path, or weight\\tMETHOD\\tpath[\\tbodyRef]")
+	}
+	weight, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return specLine{}, fmt.Errorf("invalid weight %q: %v", parts[0], err.Error())
+	}
+	sl := specLine{RequestSpec: load.RequestSpec{URL: parts[2], Method: parts[1], Weight: weight}}
+	if len(parts) == 4 {
+		sl.bodyRef = parts[3]
+	}
+	return sl, nil
 }
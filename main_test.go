@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseSpecLineBarePath(t *testing.T) {
+	sl, err := parseSpecLine("/foo")
+	if err != nil {
+		t.Fatalf("parseSpecLine() error: %v", err)
+	}
+	if sl.URL != "/foo" || sl.Method != http.MethodGet || sl.Weight != 1 {
+		t.Errorf("parseSpecLine(%q) = %+v, want URL=/foo Method=GET Weight=1", "/foo", sl.RequestSpec)
+	}
+	if sl.bodyRef != "" {
+		t.Errorf("bodyRef = %q, want empty", sl.bodyRef)
+	}
+}
+
+func TestParseSpecLineWeightedNoBody(t *testing.T) {
+	sl, err := parseSpecLine("2.5\tPOST\t/like")
+	if err != nil {
+		t.Fatalf("parseSpecLine() error: %v", err)
+	}
+	if sl.URL != "/like" || sl.Method != "POST" || sl.Weight != 2.5 {
+		t.Errorf("parseSpecLine() = %+v, want URL=/like Method=POST Weight=2.5", sl.RequestSpec)
+	}
+	if sl.bodyRef != "" {
+		t.Errorf("bodyRef = %q, want empty", sl.bodyRef)
+	}
+}
+
+func TestParseSpecLineWeightedWithBody(t *testing.T) {
+	sl, err := parseSpecLine("1\tPOST\t/upload\tbody.bin")
+	if err != nil {
+		t.Fatalf("parseSpecLine() error: %v", err)
+	}
+	if sl.URL != "/upload" || sl.Method != "POST" || sl.Weight != 1 {
+		t.Errorf("parseSpecLine() = %+v, want URL=/upload Method=POST Weight=1", sl.RequestSpec)
+	}
+	if sl.bodyRef != "body.bin" {
+		t.Errorf("bodyRef = %q, want %q", sl.bodyRef, "body.bin")
+	}
+}
+
+func TestParseSpecLineInvalid(t *testing.T) {
+	cases := []string{
+		"1\tGET",
+		"1\tGET\t/a\tb\tc",
+		"notaweight\tGET\t/a",
+	}
+	for _, line := range cases {
+		if _, err := parseSpecLine(line); err == nil {
+			t.Errorf("parseSpecLine(%q) returned nil error, want error", line)
+		}
+	}
+}